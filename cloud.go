@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+)
+
+const defaultCloudEnvironment = "AzurePublic"
+
+// cloudEnvironment bundles everything push and run need to address a
+// specific Azure cloud: the azcore.Cloud configuration used by every ARM
+// and azidentity client, plus the storage DNS suffix, which azcore.cloud
+// does not track and which we need to build blob service URLs.
+type cloudEnvironment struct {
+	Name                  string
+	Configuration         cloud.Configuration
+	StorageEndpointSuffix string
+}
+
+// resolveCloudEnvironment turns a --cloudEnvironment value into a
+// cloudEnvironment. AzurePublic, AzureChina and AzureGovernment use the
+// well-known configurations shipped with azcore/cloud. AzureStack has no
+// fixed endpoint set, so azureStackMetadataURL must point at the stack's
+// resource manager, and the real endpoints are discovered from its
+// /metadata/endpoints document at runtime.
+func resolveCloudEnvironment(name, azureStackMetadataURL string) (*cloudEnvironment, error) {
+	switch name {
+	case "", "AzurePublic":
+		return &cloudEnvironment{Name: "AzurePublic", Configuration: cloud.AzurePublic, StorageEndpointSuffix: "core.windows.net"}, nil
+	case "AzureChina":
+		return &cloudEnvironment{Name: "AzureChina", Configuration: cloud.AzureChina, StorageEndpointSuffix: "core.chinacloudapi.cn"}, nil
+	case "AzureGovernment":
+		return &cloudEnvironment{Name: "AzureGovernment", Configuration: cloud.AzureGovernment, StorageEndpointSuffix: "core.usgovcloudapi.net"}, nil
+	case "AzureStack":
+		if azureStackMetadataURL == "" {
+			return nil, fmt.Errorf("AzureStack requires --azureStackMetadataURL (or AZURE_STACK_METADATA_URL)")
+		}
+		return discoverAzureStackEnvironment(azureStackMetadataURL)
+	default:
+		return nil, fmt.Errorf("unknown cloudEnvironment %q (want AzurePublic, AzureChina, AzureGovernment or AzureStack)", name)
+	}
+}
+
+// azureStackEndpoints mirrors the subset of the AzureStack
+// /metadata/endpoints response (api-version=2015-01-01) that we need to
+// build a cloud.Configuration and a storage DNS suffix.
+type azureStackEndpoints struct {
+	GalleryEndpoint string `json:"galleryEndpoint"`
+	GraphEndpoint   string `json:"graphEndpoint"`
+	Authentication  struct {
+		LoginEndpoint string   `json:"loginEndpoint"`
+		Audiences     []string `json:"audiences"`
+	} `json:"authentication"`
+	Suffixes struct {
+		StorageEndpointSuffix string `json:"storageEndpointSuffix"`
+	} `json:"suffixes"`
+}
+
+func discoverAzureStackEnvironment(metadataURL string) (*cloudEnvironment, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/metadata/endpoints?api-version=2015-01-01", metadataURL))
+	if err != nil {
+		return nil, fmt.Errorf("fetching AzureStack endpoints: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching AzureStack endpoints: unexpected status %s", resp.Status)
+	}
+
+	var endpoints azureStackEndpoints
+	if err := json.NewDecoder(resp.Body).Decode(&endpoints); err != nil {
+		return nil, fmt.Errorf("decoding AzureStack endpoints: %w", err)
+	}
+
+	if len(endpoints.Authentication.Audiences) == 0 {
+		return nil, fmt.Errorf("AzureStack metadata at %s did not return an audience", metadataURL)
+	}
+
+	configuration := cloud.Configuration{
+		ActiveDirectoryAuthorityHost: endpoints.Authentication.LoginEndpoint,
+		Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+			cloud.ResourceManager: {
+				Endpoint: metadataURL,
+				Audience: endpoints.Authentication.Audiences[0],
+			},
+		},
+	}
+
+	return &cloudEnvironment{
+		Name:                  "AzureStack",
+		Configuration:         configuration,
+		StorageEndpointSuffix: endpoints.Suffixes.StorageEndpointSuffix,
+	}, nil
+}
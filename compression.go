@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const defaultCompression = "auto"
+
+// decompressVHD makes sure localVHDPath points at an uncompressed .vhd file
+// before the rest of push runs the VHD validator and diskstream over it.
+// mode is one of auto|none|xz|zstd; "auto" sniffs the .vhd.xz / .vhd.zst
+// extension CI pipelines commonly publish. When decompression happens, the
+// VHD is streamed into a temp file next to the source image and the
+// returned cleanup function removes it; MD5/metadata are then computed from
+// that decompressed file rather than the compressed source.
+func decompressVHD(localVHDPath, mode string) (path string, cleanup func(), err error) {
+	switch resolveCompression(localVHDPath, mode) {
+	case "none":
+		return localVHDPath, func() {}, nil
+	case "xz":
+		return decompressVHDWith(localVHDPath, func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) })
+	case "zstd":
+		return decompressVHDWith(localVHDPath, func(r io.Reader) (io.Reader, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		})
+	default:
+		return "", nil, fmt.Errorf("unknown compression %q (want auto, none, xz or zstd)", mode)
+	}
+}
+
+func resolveCompression(localVHDPath, mode string) string {
+	if mode != "auto" {
+		return mode
+	}
+
+	switch {
+	case strings.HasSuffix(localVHDPath, ".vhd.xz"):
+		return "xz"
+	case strings.HasSuffix(localVHDPath, ".vhd.zst"):
+		return "zstd"
+	default:
+		return "none"
+	}
+}
+
+func decompressVHDWith(localVHDPath string, newReader func(io.Reader) (io.Reader, error)) (string, func(), error) {
+	source, err := os.Open(localVHDPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("opening %s: %w", localVHDPath, err)
+	}
+	defer source.Close()
+
+	reader, err := newReader(source)
+	if err != nil {
+		return "", nil, fmt.Errorf("initializing decompressor for %s: %w", localVHDPath, err)
+	}
+
+	// The decompressed path is derived deterministically from localVHDPath
+	// (not os.CreateTemp's randomized name) so that the .upload-state.json
+	// file --resume looks for sits at a stable path across runs, instead of
+	// changing every time push decompresses the source again.
+	destPath := filepath.Join(filepath.Dir(localVHDPath), filepath.Base(localVHDPath)+".decompressed.vhd")
+	dest, err := os.Create(destPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("creating temp file for decompressed VHD: %w", err)
+	}
+
+	fmt.Printf("Decompressing %s to %s\n", localVHDPath, dest.Name())
+
+	if _, err := io.Copy(dest, reader); err != nil {
+		dest.Close()
+		os.Remove(dest.Name())
+		return "", nil, fmt.Errorf("decompressing %s: %w", localVHDPath, err)
+	}
+
+	if err := dest.Close(); err != nil {
+		os.Remove(dest.Name())
+		return "", nil, fmt.Errorf("closing decompressed VHD: %w", err)
+	}
+
+	path := dest.Name()
+	cleanup := func() {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Unable to remove temporary decompressed VHD %s: %v", path, err)
+		}
+	}
+
+	return path, cleanup, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute"
+)
+
+// galleryPublishOptions describes the Shared Image Gallery target a freshly
+// uploaded VHD should be published to, once it has landed in the storage
+// account as a page blob.
+type galleryPublishOptions struct {
+	Gallery          string
+	ImageDefinition  string
+	ImageVersion     string
+	ReplicaRegions   []string
+	HyperVGeneration string
+}
+
+// newGalleryClients builds the ARM clients publishVHDToGallery needs,
+// pinned to environment's cloud configuration like every other ARM client
+// in this tool.
+func newGalleryClients(subscriptionID string, credential azcore.TokenCredential, environment *cloudEnvironment) (*armcompute.DisksClient, *armcompute.GalleryImageVersionsClient, error) {
+	clientOptions := &arm.ClientOptions{ClientOptions: azcore.ClientOptions{Cloud: environment.Configuration}}
+
+	disksClient, err := armcompute.NewDisksClient(subscriptionID, credential, clientOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating disks client: %w", err)
+	}
+
+	galleryImageVersionsClient, err := armcompute.NewGalleryImageVersionsClient(subscriptionID, credential, clientOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating gallery image versions client: %w", err)
+	}
+
+	return disksClient, galleryImageVersionsClient, nil
+}
+
+// publishVHDToGallery turns the page blob at blobURI, in accountName, into
+// a managed disk, wraps that disk in a gallery image version under
+// opts.Gallery / opts.ImageDefinition, replicates it to
+// opts.ReplicaRegions, and removes the intermediate disk once the gallery
+// image version has published successfully.
+func publishVHDToGallery(ctx context.Context, subscriptionID, resourceGroupName, location, accountName, diskName, blobURI string, credential azcore.TokenCredential, environment *cloudEnvironment, opts galleryPublishOptions) error {
+	disksClient, galleryImageVersionsClient, err := newGalleryClients(subscriptionID, credential, environment)
+	if err != nil {
+		return err
+	}
+
+	hyperVGen := armcompute.HyperVGeneration(opts.HyperVGeneration)
+	if hyperVGen == "" {
+		hyperVGen = armcompute.HyperVGenerationV1
+	}
+
+	storageAccountID := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s", subscriptionID, resourceGroupName, accountName)
+
+	fmt.Printf("Creating managed disk %s from %s\n", diskName, blobURI)
+	createPoller, err := disksClient.BeginCreateOrUpdate(ctx, resourceGroupName, diskName, armcompute.Disk{
+		Location: &location,
+		Properties: &armcompute.DiskProperties{
+			OSType:           ptrTo(armcompute.OperatingSystemTypesLinux),
+			HyperVGeneration: &hyperVGen,
+			CreationData: &armcompute.CreationData{
+				CreateOption:     ptrTo(armcompute.DiskCreateOptionImport),
+				SourceURI:        &blobURI,
+				StorageAccountID: &storageAccountID,
+			},
+		},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("creating managed disk: %w", err)
+	}
+
+	diskResp, err := createPoller.PollUntilDone(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("waiting for managed disk creation: %w", err)
+	}
+
+	var targetRegions []*armcompute.TargetRegion
+	for _, region := range opts.ReplicaRegions {
+		region := strings.TrimSpace(region)
+		if region == "" {
+			continue
+		}
+		targetRegions = append(targetRegions, &armcompute.TargetRegion{Name: &region})
+	}
+
+	fmt.Printf("Publishing gallery image version %s/%s/%s\n", opts.Gallery, opts.ImageDefinition, opts.ImageVersion)
+	versionPoller, err := galleryImageVersionsClient.BeginCreateOrUpdate(ctx, resourceGroupName, opts.Gallery, opts.ImageDefinition, opts.ImageVersion, armcompute.GalleryImageVersion{
+		Location: &location,
+		Properties: &armcompute.GalleryImageVersionProperties{
+			PublishingProfile: &armcompute.GalleryImageVersionPublishingProfile{
+				TargetRegions: targetRegions,
+			},
+			StorageProfile: &armcompute.GalleryImageVersionStorageProfile{
+				OSDiskImage: &armcompute.GalleryOSDiskImage{
+					Source: &armcompute.GalleryDiskImageSource{
+						ID: diskResp.ID,
+					},
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("creating gallery image version: %w", err)
+	}
+
+	if _, err := versionPoller.PollUntilDone(ctx, nil); err != nil {
+		return fmt.Errorf("waiting for gallery image version: %w", err)
+	}
+
+	fmt.Printf("Cleaning up intermediate disk %s\n", diskName)
+	deletePoller, err := disksClient.BeginDelete(ctx, resourceGroupName, diskName, nil)
+	if err != nil {
+		return fmt.Errorf("deleting intermediate disk: %w", err)
+	}
+	if _, err := deletePoller.PollUntilDone(ctx, nil); err != nil {
+		return fmt.Errorf("waiting for intermediate disk deletion: %w", err)
+	}
+
+	return nil
+}
+
+func ptrTo[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+)
+
+const defaultStorageSKU = "Standard_LRS"
+
+// ensureInfrastructure creates whatever push needs and doesn't find already
+// in place: the resource group, then the storage account inside it. It
+// mirrors the BlobDiskController pattern in Kubernetes' Azure cloud
+// provider (createStorageAccount / getStorageAccesskey) so operators no
+// longer have to pre-create everything by hand before their first push.
+func ensureInfrastructure(ctx context.Context, resourceGroupName, accountName, location, sku string) error {
+	if err := ensureResourceGroup(ctx, resourceGroupName, location); err != nil {
+		return fmt.Errorf("ensuring resource group: %w", err)
+	}
+
+	if err := ensureStorageAccount(ctx, resourceGroupName, accountName, location, sku); err != nil {
+		return fmt.Errorf("ensuring storage account: %w", err)
+	}
+
+	return nil
+}
+
+func ensureResourceGroup(ctx context.Context, resourceGroupName, location string) error {
+	exists, err := groupsClient.CheckExistence(ctx, resourceGroupName, nil)
+	if err != nil {
+		return fmt.Errorf("checking resource group existence: %w", err)
+	}
+
+	if exists.Success {
+		return nil
+	}
+
+	fmt.Printf("Resource group %s does not exist, creating it in %s\n", resourceGroupName, location)
+	_, err = groupsClient.CreateOrUpdate(ctx, resourceGroupName, armresources.ResourceGroup{
+		Location: &location,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("creating resource group: %w", err)
+	}
+
+	return nil
+}
+
+func ensureStorageAccount(ctx context.Context, resourceGroupName, accountName, location, sku string) error {
+	_, err := accountsClient.GetProperties(ctx, resourceGroupName, accountName, nil)
+	if err == nil {
+		return nil
+	}
+	if !isNotFound(err) {
+		return fmt.Errorf("looking up storage account: %w", err)
+	}
+
+	availability, err := accountsClient.CheckNameAvailability(ctx, armstorage.AccountCheckNameAvailabilityParameters{
+		Name: &accountName,
+		Type: ptrTo("Microsoft.Storage/storageAccounts"),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("checking storage account name availability: %w", err)
+	}
+	if availability.NameAvailable != nil && !*availability.NameAvailable {
+		return fmt.Errorf("storage account name %s is not available: %s", accountName, derefString(availability.Message))
+	}
+
+	fmt.Printf("Storage account %s does not exist, creating it in %s (%s)\n", accountName, location, sku)
+	poller, err := accountsClient.BeginCreate(ctx, resourceGroupName, accountName, armstorage.AccountCreateParameters{
+		Location: &location,
+		SKU:      &armstorage.SKU{Name: ptrTo(armstorage.SKUName(sku))},
+		Kind:     ptrTo(armstorage.KindStorageV2),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("creating storage account: %w", err)
+	}
+
+	if _, err := poller.PollUntilDone(ctx, nil); err != nil {
+		return fmt.Errorf("waiting for storage account creation: %w", err)
+	}
+
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == 404
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"flag"
 	"fmt"
@@ -8,13 +10,19 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-
-	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
-	"github.com/Azure/azure-sdk-for-go/arm/storage"
-	simpleStorage "github.com/Azure/azure-sdk-for-go/storage"
-	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/adal"
-	"github.com/Azure/go-autorest/autorest/azure"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
 	"github.com/Microsoft/azure-vhd-utils/upload"
 	uploadMetaData "github.com/Microsoft/azure-vhd-utils/upload/metadata"
 	"github.com/Microsoft/azure-vhd-utils/vhdcore/common"
@@ -27,15 +35,14 @@ const (
 	defaultAccountName          = "linuxkit"
 	defaultStorageContainerName = "linuxkitcontainer"
 	defaultStorageBlobName      = "linuxkitimage.vhd"
+
+	pageBlobPageSize int64 = 2 * 1024 * 1024
 )
 
 var (
-	groupsClient        resources.GroupsClient
-	simpleStorageClient simpleStorage.Client
-	accountsClient      storage.AccountsClient
-
-	defaultActiveDirectoryEndpoint = azure.PublicCloud.ActiveDirectoryEndpoint
-	defaultResourceManagerEndpoint = azure.PublicCloud.ResourceManagerEndpoint
+	groupsClient   *armresources.ResourceGroupsClient
+	accountsClient *armstorage.AccountsClient
+	credential     azcore.TokenCredential
 )
 
 func push(args []string) {
@@ -52,50 +59,136 @@ func push(args []string) {
 	resourceGroupName := flags.String("resourceGroupName", "", "Name of the resource group where to upload the image")
 	location := flags.String("location", defaultLocation, "Location of the storage account to upload the image")
 	accountName := flags.String("accountName", defaultAccountName, "Name of the storage account")
+	cloudEnv := flags.String("cloudEnvironment", getEnvVarOrDefault("AZURE_ENVIRONMENT", defaultCloudEnvironment), "Azure cloud to target: AzurePublic, AzureChina, AzureGovernment or AzureStack")
+	azureStackMetadataURL := flags.String("azureStackMetadataURL", os.Getenv("AZURE_STACK_METADATA_URL"), "Resource manager endpoint to discover AzureStack's endpoint set from (required when cloudEnvironment=AzureStack)")
+	gallery := flags.String("gallery", "", "Shared Image Gallery to publish the uploaded VHD into (skipped when empty)")
+	imageDefinition := flags.String("imageDefinition", "", "Gallery image definition to publish the new version under")
+	imageVersion := flags.String("imageVersion", "", "Gallery image version to publish, e.g. 1.0.0")
+	replicaRegions := flags.String("replicaRegions", "", "Comma-separated list of additional regions to replicate the gallery image version to")
+	hyperVGeneration := flags.String("hyperVGeneration", "V1", "Hyper-V generation of the published gallery image: V1 or V2")
+	compression := flags.String("compression", defaultCompression, "Compression of imagePath: auto, none, xz or zstd")
+	sku := flags.String("sku", defaultStorageSKU, "SKU to use when the storage account needs to be created: Standard_LRS or Premium_LRS")
+	containerName := flags.String("containerName", defaultStorageContainerName, "Name of the blob container to upload the VHD into")
+	blobName := flags.String("blobName", defaultStorageBlobName, "Name of the destination VHD blob")
+	resume := flags.Bool("resume", false, "Resume a previous push using the .upload-state.json file next to imagePath")
+	shardAccounts := flags.Int("accounts", 1, "Spread the upload across N storage accounts (named accountName0, accountName1, ...) to bypass the per-account ingress cap, then stitch the shards into the destination blob")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatalf("Unable to parse args: %v", err)
 	}
 
-	fmt.Printf("Invoked with args: %s, %s, %s", *resourceGroupName, *location, *accountName)
-}
+	if len(flags.Args()) < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
 
-func initializeAzureClients(subscriptionID, tenantID, clientID, clientSecret string) {
-	oAuthConfig, err := adal.NewOAuthConfig(defaultActiveDirectoryEndpoint, tenantID)
+	subscriptionID := getEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	clientSecret := os.Getenv("AZURE_CLIENT_SECRET")
+
+	environment, err := resolveCloudEnvironment(*cloudEnv, *azureStackMetadataURL)
 	if err != nil {
-		log.Fatalf("Cannot get oAuth configuration: %v", err)
+		log.Fatalf("Unable to resolve cloud environment: %v", err)
 	}
 
-	token, err := adal.NewServicePrincipalToken(*oAuthConfig, clientID, clientSecret, defaultResourceManagerEndpoint)
+	initializeAzureClients(subscriptionID, tenantID, clientID, clientSecret, environment)
+
+	fmt.Printf("Invoked with args: %s, %s, %s\n", *resourceGroupName, *location, *accountName)
+
+	blobURI := uploadVMImage(*resourceGroupName, *accountName, flags.Args()[0], *location, *sku, *containerName, *blobName, *resume, *shardAccounts, environment, *compression)
+
+	if *gallery == "" {
+		return
+	}
+
+	diskName := (*blobName)[:len(*blobName)-len(filepath.Ext(*blobName))]
+	ctx := context.Background()
+	opts := galleryPublishOptions{
+		Gallery:          *gallery,
+		ImageDefinition:  *imageDefinition,
+		ImageVersion:     *imageVersion,
+		ReplicaRegions:   strings.Split(*replicaRegions, ","),
+		HyperVGeneration: *hyperVGeneration,
+	}
+	if err := publishVHDToGallery(ctx, subscriptionID, *resourceGroupName, *location, *accountName, diskName, blobURI, credential, environment, opts); err != nil {
+		log.Fatalf("Unable to publish to Shared Image Gallery: %v", err)
+	}
+}
+
+func getEnvVarOrDefault(varName, def string) string {
+	if value := os.Getenv(varName); value != "" {
+		return value
+	}
+	return def
+}
+
+// initializeAzureClients builds the ARM and data-plane clients used by push
+// and run. It authenticates with azidentity.NewDefaultAzureCredential unless
+// AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET are all set, in
+// which case it falls back to a client-secret credential so existing
+// service-principal based setups keep working. Both the credential and the
+// ARM clients are pinned to environment's cloud configuration so AzureChina,
+// AzureGovernment and AzureStack resolve the right AD and ARM endpoints.
+func initializeAzureClients(subscriptionID, tenantID, clientID, clientSecret string, environment *cloudEnvironment) {
+	var err error
+	credential, err = newAzureCredential(tenantID, clientID, clientSecret, environment)
 	if err != nil {
-		log.Fatalf("Cannot get service principal token: %v", err)
+		log.Fatalf("Unable to create Azure credential: %v", err)
 	}
 
-	groupsClient = resources.NewGroupsClient(subscriptionID)
-	groupsClient.Authorizer = autorest.NewBearerAuthorizer(token)
+	clientOptions := &arm.ClientOptions{
+		ClientOptions: azcore.ClientOptions{Cloud: environment.Configuration},
+	}
 
-	accountsClient = storage.NewAccountsClient(subscriptionID)
-	accountsClient.Authorizer = autorest.NewBearerAuthorizer(token)
+	groupsClient, err = armresources.NewResourceGroupsClient(subscriptionID, credential, clientOptions)
+	if err != nil {
+		log.Fatalf("Unable to create resource groups client: %v", err)
+	}
 
+	accountsClient, err = armstorage.NewAccountsClient(subscriptionID, credential, clientOptions)
+	if err != nil {
+		log.Fatalf("Unable to create storage accounts client: %v", err)
+	}
 }
 
-func uploadVMImage(resourceGroupName string, accountName string, imagePath string) {
+// newAzureCredential returns a client-secret credential when tenantID,
+// clientID and clientSecret are all populated, and falls back to
+// DefaultAzureCredential (managed identity, az login, env vars, ...)
+// otherwise. Both paths are pinned to environment's cloud configuration.
+func newAzureCredential(tenantID, clientID, clientSecret string, environment *cloudEnvironment) (azcore.TokenCredential, error) {
+	clientOptions := azcore.ClientOptions{Cloud: environment.Configuration}
+
+	if tenantID != "" && clientID != "" && clientSecret != "" {
+		return azidentity.NewClientSecretCredential(tenantID, clientID, clientSecret, &azidentity.ClientSecretCredentialOptions{
+			ClientOptions: clientOptions,
+		})
+	}
+
+	return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+		ClientOptions: clientOptions,
+	})
+}
 
-	const PageBlobPageSize int64 = 2 * 1024 * 1024
+func uploadVMImage(resourceGroupName string, accountName string, imagePath string, location string, sku string, containerName string, blobName string, resume bool, shardAccounts int, environment *cloudEnvironment, compression string) string {
+	ctx := context.Background()
 	parallelism := 8 * runtime.NumCPU()
 
-	accountKeys, err := accountsClient.ListKeys(resourceGroupName, accountName)
-	if err != nil {
-		log.Fatalf("Unable to retrieve storage account key: %v", err)
+	if err := ensureInfrastructure(ctx, resourceGroupName, accountName, location, sku); err != nil {
+		log.Fatalf("Unable to ensure infrastructure: %v", err)
 	}
 
-	keys := *(accountKeys.Keys)
-
 	absolutePath, err := filepath.Abs(imagePath)
 	if err != nil {
 		log.Fatalf("Unable to get absolute path: %v", err)
 	}
 
+	absolutePath, cleanup, err := decompressVHD(absolutePath, compression)
+	if err != nil {
+		log.Fatalf("Unable to decompress VHD: %v", err)
+	}
+	defer cleanup()
+
 	ensureVHDSanity(absolutePath)
 
 	diskStream, err := diskstream.CreateNewDiskStream(absolutePath)
@@ -104,60 +197,215 @@ func uploadVMImage(resourceGroupName string, accountName string, imagePath strin
 	}
 	defer diskStream.Close()
 
-	simpleStorageClient, err = simpleStorage.NewBasicClient(accountName, *keys[0].Value)
+	serviceClient, err := newBlobServiceClient(ctx, resourceGroupName, accountName, environment)
 	if err != nil {
-		log.Fatalf("Unable to create simple storage client: %v", err)
+		log.Fatalf("Unable to create blob service client: %v", err)
 	}
 
-	blobServiceClient := simpleStorageClient.GetBlobService()
-	_, err = blobServiceClient.CreateContainerIfNotExists(defaultStorageContainerName, simpleStorage.ContainerAccessTypePrivate)
-	if err != nil {
+	containerClient := serviceClient.ServiceClient().NewContainerClient(containerName)
+	if _, err := containerClient.Create(ctx, nil); err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
 		log.Fatalf("Unable to create or retrieve container: %v", err)
 	}
 
-	localMetaData := getLocalVHDMetaData(absolutePath)
+	statePath := uploadStatePath(absolutePath)
+	state, err := loadUploadState(statePath)
+	if err != nil {
+		log.Fatalf("Unable to read upload state: %v", err)
+	}
 
-	err = blobServiceClient.PutPageBlob(defaultStorageContainerName, defaultStorageBlobName, diskStream.GetSize(), nil)
+	sourceInfo, err := os.Stat(absolutePath)
 	if err != nil {
-		log.Fatalf("Unable to create VHD blob: %v", err)
+		log.Fatalf("Unable to stat VHD: %v", err)
 	}
 
-	m, _ := localMetaData.ToMap()
-	err = blobServiceClient.SetBlobMetadata(defaultStorageContainerName, defaultStorageBlobName, m, make(map[string]string))
+	// A resumed push whose source size and modification time still match
+	// the state file's can trust its MD5 and range list outright, instead
+	// of re-hashing the whole (possibly multi-GB) VHD and re-running
+	// DetectEmptyRanges over it just to throw the result away.
+	cached := resume && state.matchesSource(sourceInfo)
+
+	var (
+		m                map[string]string
+		md5              string
+		uploadableRanges []*common.IndexRange
+	)
+
+	if cached {
+		fmt.Printf("Resuming: source unchanged since last run, reusing cached MD5 and ranges from %s\n", statePath)
+		md5 = state.MD5
+		uploadableRanges = state.allIndexRanges()
+	} else {
+		if !resume {
+			state = &uploadState{}
+		}
+
+		localMetaData := getLocalVHDMetaData(absolutePath)
+		m, _ = localMetaData.ToMap()
+		md5 = base64.StdEncoding.EncodeToString(localMetaData.FileMetaData.MD5Hash)
+
+		var rangesToSkip []*common.IndexRange
+		uploadableRanges, err = upload.LocateUploadableRanges(diskStream, rangesToSkip, pageBlobPageSize)
+		if err != nil {
+			log.Fatalf("Unable to locate uploadable ranges: %v", err)
+		}
+
+		uploadableRanges, err = upload.DetectEmptyRanges(diskStream, uploadableRanges)
+		if err != nil {
+			log.Fatalf("Unable to detect empty blob ranges: %v", err)
+		}
+
+		if err := state.recordSource(statePath, md5, sourceInfo, uploadableRanges); err != nil {
+			log.Fatalf("Unable to persist upload state: %v", err)
+		}
+	}
+
+	pageBlobClient := containerClient.NewPageBlobClient(blobName)
+
+	// Creating a page blob over an existing one replaces it with an empty
+	// blob, so a resumed push keeps an existing blob of the right size and
+	// only skips already-uploaded ranges when it does.
+	keepExisting := false
+	if resume {
+		props, err := pageBlobClient.GetProperties(ctx, nil)
+		keepExisting = err == nil && props.ContentLength != nil && *props.ContentLength == diskStream.GetSize()
+	}
+
+	if !keepExisting {
+		_, err = pageBlobClient.Create(ctx, diskStream.GetSize(), &pageblob.CreateOptions{
+			Metadata: toAzblobMetadata(m),
+		})
+		if err != nil {
+			log.Fatalf("Unable to create VHD blob: %v", err)
+		}
+	}
+
+	if keepExisting {
+		before := len(uploadableRanges)
+		uploadableRanges = state.pendingRanges(md5, uploadableRanges)
+		fmt.Printf("Resuming: %d/%d ranges already uploaded\n", before-len(uploadableRanges), before)
+	}
+
+	if shardAccounts > 1 {
+		err = uploadVHDSharded(ctx, diskStream, uploadableRanges, parallelism, pageBlobClient, resourceGroupName, accountName, location, sku, shardAccounts, environment, state, statePath, md5)
+	} else {
+		err = uploadRangesToPageBlob(ctx, pageBlobClient, diskStream, uploadableRanges, parallelism, state, statePath, md5)
+	}
 	if err != nil {
-		log.Fatalf("Unable to set blob metatada: %v", err)
+		log.Fatalf("Unable to upload VHD: %v", err)
 	}
 
-	var rangesToSkip []*common.IndexRange
-	uploadableRanges, err := upload.LocateUploadableRanges(diskStream, rangesToSkip, PageBlobPageSize)
+	md5Hash, err := base64.StdEncoding.DecodeString(md5)
 	if err != nil {
-		log.Fatalf("Unable to locate uploadable ranges: %v", err)
+		log.Fatalf("Unable to decode VHD MD5: %v", err)
+	}
+	setBlobMD5Hash(ctx, pageBlobClient, md5Hash)
+
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to remove upload state file %s: %v", statePath, err)
 	}
 
-	uploadableRanges, err = upload.DetectEmptyRanges(diskStream, uploadableRanges)
+	return pageBlobClient.URL()
+}
+
+// accountSharedKeyCredential fetches accountName's primary key and wraps it
+// in a SharedKeyCredential, the one credential type that can both
+// authenticate a blob service client and sign a SAS for that account.
+func accountSharedKeyCredential(ctx context.Context, resourceGroupName, accountName string) (*azblob.SharedKeyCredential, error) {
+	keysResp, err := accountsClient.ListKeys(ctx, resourceGroupName, accountName, nil)
 	if err != nil {
-		log.Fatalf("Unable to detect empty blob ranges: %v", err)
+		return nil, fmt.Errorf("retrieving storage account key: %w", err)
 	}
 
-	cxt := &upload.DiskUploadContext{
-		VhdStream:             diskStream,
-		UploadableRanges:      uploadableRanges,
-		AlreadyProcessedBytes: common.TotalRangeLength(rangesToSkip),
-		BlobServiceClient:     blobServiceClient,
-		ContainerName:         defaultStorageContainerName,
-		BlobName:              defaultStorageBlobName,
-		Parallelism:           parallelism,
-		Resume:                false,
-		MD5Hash:               localMetaData.FileMetaData.MD5Hash,
+	keys := keysResp.Keys
+	if len(keys) == 0 || keys[0].Value == nil {
+		return nil, fmt.Errorf("storage account %s returned no usable keys", accountName)
 	}
 
-	err = upload.Upload(cxt)
+	return azblob.NewSharedKeyCredential(accountName, *keys[0].Value)
+}
+
+// newBlobServiceClient authenticates to accountName's blob endpoint with
+// its account key, pinned to environment's storage DNS suffix.
+func newBlobServiceClient(ctx context.Context, resourceGroupName, accountName string, environment *cloudEnvironment) (*azblob.Client, error) {
+	sharedKeyCredential, err := accountSharedKeyCredential(ctx, resourceGroupName, accountName)
 	if err != nil {
-		log.Fatalf("Unable to upload VHD: %v", err)
+		return nil, err
+	}
+
+	serviceURL := fmt.Sprintf("https://%s.blob.%s/", accountName, environment.StorageEndpointSuffix)
+	return azblob.NewClientWithSharedKeyCredential(serviceURL, sharedKeyCredential, nil)
+}
+
+// uploadRangesToPageBlob pushes every uploadable range of the VHD into the
+// given page blob, reading from diskStream and writing with UploadPages. Up
+// to parallelism ranges are in flight at a time. Each completed range is
+// recorded in state, which throttles how often it actually rewrites
+// statePath, so a later --resume can skip it; a final, unthrottled flush
+// after every worker finishes makes sure nothing in the last interval is
+// lost. Pass a zero-value state and an empty statePath to opt out.
+//
+// diskStream carries internal position state and is not safe for
+// concurrent reads (the upstream azure-vhd-utils uploader only ever reads
+// it from one goroutine), so every ReadAt is serialized through readMu
+// while the actual network upload still runs with parallelism workers in
+// flight.
+func uploadRangesToPageBlob(ctx context.Context, client *pageblob.Client, diskStream *diskstream.DiskStream, ranges []*common.IndexRange, parallelism int, state *uploadState, statePath, md5 string) error {
+	sem := make(chan struct{}, parallelism)
+	errs := make(chan error, len(ranges))
+	var wg sync.WaitGroup
+	var readMu sync.Mutex
+
+	for _, r := range ranges {
+		rangeToUpload := r
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			length := rangeToUpload.Length()
+			buffer := make([]byte, length)
+			readMu.Lock()
+			_, err := diskStream.ReadAt(buffer, rangeToUpload.Start)
+			readMu.Unlock()
+			if err != nil {
+				errs <- fmt.Errorf("reading range %d-%d: %w", rangeToUpload.Start, rangeToUpload.End, err)
+				return
+			}
+
+			_, err = client.UploadPages(ctx, streaming.NopCloser(bytes.NewReader(buffer)), &pageblob.UploadPagesOptions{
+				Range: blob.HTTPRange{Offset: rangeToUpload.Start, Count: length},
+			})
+			if err != nil {
+				errs <- fmt.Errorf("uploading range %d-%d: %w", rangeToUpload.Start, rangeToUpload.End, err)
+				return
+			}
+
+			if statePath != "" {
+				if err := state.markUploaded(statePath, md5, rangeToUpload); err != nil {
+					log.Printf("Unable to persist upload state for range %d-%d: %v", rangeToUpload.Start, rangeToUpload.End, err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	if statePath != "" {
+		if err := state.flush(statePath); err != nil {
+			log.Printf("Unable to persist upload state: %v", err)
+		}
 	}
 
-	setBlobMD5Hash(blobServiceClient, defaultStorageContainerName, defaultStorageBlobName, localMetaData)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 
+	return nil
 }
 
 func getEnvVarOrExit(varName string) string {
@@ -187,13 +435,22 @@ func getLocalVHDMetaData(localVHDPath string) *uploadMetaData.MetaData {
 	return localMetaData
 }
 
-func setBlobMD5Hash(client simpleStorage.BlobStorageClient, containerName, blobName string, vhdMetaData *uploadMetaData.MetaData) {
-	if vhdMetaData.FileMetaData.MD5Hash != nil {
-		blobHeaders := simpleStorage.BlobHeaders{
-			ContentMD5: base64.StdEncoding.EncodeToString(vhdMetaData.FileMetaData.MD5Hash),
-		}
-		if err := client.SetBlobProperties(containerName, blobName, blobHeaders); err != nil {
+func setBlobMD5Hash(ctx context.Context, client *pageblob.Client, md5Hash []byte) {
+	if len(md5Hash) > 0 {
+		_, err := client.SetHTTPHeaders(ctx, blob.HTTPHeaders{
+			BlobContentMD5: md5Hash,
+		}, nil)
+		if err != nil {
 			log.Fatalf("Unable to set blob properties: %v", err)
 		}
 	}
 }
+
+func toAzblobMetadata(m map[string]string) map[string]*string {
+	metadata := make(map[string]*string, len(m))
+	for k, v := range m {
+		value := v
+		metadata[k] = &value
+	}
+	return metadata
+}
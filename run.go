@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+)
+
+// deploymentPollInterval is how often streamDeploymentOperations re-polls
+// both the deployment itself and its operations list while waiting for a
+// terminal provisioning state.
+const deploymentPollInterval = 5 * time.Second
+
+//go:embed templates/azure-disk-template.json
+var defaultARMTemplate []byte
+
+func run(args []string) {
+	flags := flag.NewFlagSet("run-azure", flag.ExitOnError)
+	invoked := filepath.Base(os.Args[0])
+
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run [options]\n\n", invoked)
+		fmt.Printf("Deploys an ARM template that turns a VHD pushed with 'push' into a\n")
+		fmt.Printf("running VM. Defaults to a bundled template that creates a managed\n")
+		fmt.Printf("disk and a VM from it; pass --template to deploy a different one.\n\n")
+		flags.PrintDefaults()
+	}
+
+	resourceGroupName := flags.String("resourceGroupName", "", "Name of the resource group to deploy into")
+	deploymentName := flags.String("deploymentName", "linuxkit-deployment", "Name of the ARM deployment")
+	location := flags.String("location", defaultLocation, "Location set on the ARM deployment (the resource group itself is not created and must already exist)")
+	templatePath := flags.String("template", "", "Path or URL to an ARM JSON template (defaults to the bundled disk+VM template)")
+	parametersPath := flags.String("parameters", "", "Path to an ARM parameters JSON file")
+	accountName := flags.String("accountName", defaultAccountName, "Name of the storage account holding the VHD (used to reconstruct the blob URI when --blobUri is not set)")
+	containerName := flags.String("containerName", defaultStorageContainerName, "Name of the blob container holding the VHD")
+	blobName := flags.String("blobName", defaultStorageBlobName, "Name of the VHD blob")
+	blobURI := flags.String("blobUri", "", "Full blob URI of the VHD (overrides containerName/blobName; accountName is still passed to the bundled template as storageAccountName)")
+	sshPublicKey := flags.String("sshPublicKey", "", "SSH public key installed for adminUsername (required by the bundled template when --parameters is not set)")
+	subnetId := flags.String("subnetId", "", "Resource ID of the subnet the VM's network interface attaches to (required by the bundled template when --parameters is not set)")
+	mode := flags.String("mode", "Incremental", "Deployment mode: Incremental or Complete")
+	whatIf := flags.Bool("what-if", false, "Validate the deployment without applying it")
+	cloudEnv := flags.String("cloudEnvironment", getEnvVarOrDefault("AZURE_ENVIRONMENT", defaultCloudEnvironment), "Azure cloud to target: AzurePublic, AzureChina, AzureGovernment or AzureStack")
+	azureStackMetadataURL := flags.String("azureStackMetadataURL", os.Getenv("AZURE_STACK_METADATA_URL"), "Resource manager endpoint to discover AzureStack's endpoint set from (required when cloudEnvironment=AzureStack)")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatalf("Unable to parse args: %v", err)
+	}
+
+	subscriptionID := getEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	clientSecret := os.Getenv("AZURE_CLIENT_SECRET")
+
+	environment, err := resolveCloudEnvironment(*cloudEnv, *azureStackMetadataURL)
+	if err != nil {
+		log.Fatalf("Unable to resolve cloud environment: %v", err)
+	}
+
+	initializeAzureClients(subscriptionID, tenantID, clientID, clientSecret, environment)
+
+	uri := *blobURI
+	if uri == "" {
+		uri = fmt.Sprintf("https://%s.blob.%s/%s/%s", *accountName, environment.StorageEndpointSuffix, *containerName, *blobName)
+	}
+
+	template, err := loadARMDocument(*templatePath, defaultARMTemplate)
+	if err != nil {
+		log.Fatalf("Unable to load ARM template: %v", err)
+	}
+
+	if *templatePath == "" && *parametersPath == "" {
+		if *sshPublicKey == "" || *subnetId == "" {
+			log.Fatalf("--sshPublicKey and --subnetId are required when deploying the bundled template without --parameters")
+		}
+	}
+
+	parameters, err := loadARMParameters(*parametersPath, uri, *accountName, *sshPublicKey, *subnetId)
+	if err != nil {
+		log.Fatalf("Unable to load ARM parameters: %v", err)
+	}
+
+	if err := deployARMTemplate(context.Background(), subscriptionID, *resourceGroupName, *location, *deploymentName, template, parameters, *mode, *whatIf, environment); err != nil {
+		log.Fatalf("Deployment failed: %v", err)
+	}
+}
+
+// loadARMDocument reads an ARM JSON document (template or parameters) from a
+// local path or an HTTP(S) URL, falling back to fallback when path is empty.
+func loadARMDocument(path string, fallback []byte) (map[string]interface{}, error) {
+	var raw []byte
+	var err error
+
+	switch {
+	case path == "":
+		raw = fallback
+	case isURL(path):
+		raw, err = fetchURL(path)
+	default:
+		raw, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("parsing ARM document: %w", err)
+	}
+
+	return doc, nil
+}
+
+// loadARMParameters reads an ARM parameters file in the standard
+// {"parameters": {"name": {"value": ...}}} shape. When parametersPath is
+// empty, it synthesizes the parameters the bundled default template
+// requires beyond its own defaults: the VHD's blob URI, the storage
+// account it lives in (creationData.storageAccountId needs a full
+// resource ID), the SSH public key and the subnet to attach to.
+func loadARMParameters(parametersPath, blobURI, accountName, sshPublicKey, subnetId string) (map[string]interface{}, error) {
+	if parametersPath == "" {
+		return map[string]interface{}{
+			"vhdUri":             map[string]interface{}{"value": blobURI},
+			"storageAccountName": map[string]interface{}{"value": accountName},
+			"sshPublicKey":       map[string]interface{}{"value": sshPublicKey},
+			"subnetId":           map[string]interface{}{"value": subnetId},
+		}, nil
+	}
+
+	raw, err := os.ReadFile(parametersPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Parameters map[string]interface{} `json:"parameters"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parsing ARM parameters file: %w", err)
+	}
+
+	return file.Parameters, nil
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+func fetchURL(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: unexpected status %s", url, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// deployARMTemplate submits template/parameters as deployment
+// resourceGroupName/deploymentName and streams the deployment's operations
+// until it reaches a terminal state. In --what-if mode it runs a What-If
+// analysis instead of applying anything.
+func deployARMTemplate(ctx context.Context, subscriptionID, resourceGroupName, location, deploymentName string, template, parameters map[string]interface{}, mode string, whatIf bool, environment *cloudEnvironment) error {
+	clientOptions := &arm.ClientOptions{ClientOptions: azcore.ClientOptions{Cloud: environment.Configuration}}
+
+	deploymentsClient, err := armresources.NewDeploymentsClient(subscriptionID, credential, clientOptions)
+	if err != nil {
+		return fmt.Errorf("creating deployments client: %w", err)
+	}
+
+	properties := &armresources.DeploymentProperties{
+		Mode:       ptrTo(armresources.DeploymentMode(mode)),
+		Template:   template,
+		Parameters: parameters,
+	}
+
+	if whatIf {
+		fmt.Printf("Running what-if analysis for deployment %s\n", deploymentName)
+		poller, err := deploymentsClient.BeginWhatIf(ctx, resourceGroupName, deploymentName, armresources.DeploymentWhatIf{
+			Properties: &armresources.DeploymentWhatIfProperties{
+				Mode:       properties.Mode,
+				Template:   properties.Template,
+				Parameters: properties.Parameters,
+			},
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("starting what-if analysis: %w", err)
+		}
+
+		result, err := poller.PollUntilDone(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("running what-if analysis: %w", err)
+		}
+
+		for _, change := range result.Changes {
+			changeType := "Unknown"
+			if change.ChangeType != nil {
+				changeType = string(*change.ChangeType)
+			}
+			fmt.Printf("  %s: %s\n", derefString(change.ResourceID), changeType)
+		}
+
+		return nil
+	}
+
+	fmt.Printf("Starting deployment %s in %s\n", deploymentName, resourceGroupName)
+	poller, err := deploymentsClient.BeginCreateOrUpdate(ctx, resourceGroupName, deploymentName, armresources.Deployment{
+		Location:   &location,
+		Properties: properties,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("starting deployment: %w", err)
+	}
+
+	if err := streamDeploymentOperations(ctx, subscriptionID, resourceGroupName, deploymentName, clientOptions, poller); err != nil {
+		return fmt.Errorf("waiting for deployment: %w", err)
+	}
+
+	fmt.Printf("Deployment %s succeeded\n", deploymentName)
+	return nil
+}
+
+// streamDeploymentOperations polls deployment's operations list and the
+// deployment itself in a loop, at deploymentPollInterval, printing each
+// operation/provisioning-state pair the first time it is seen, until
+// poller reports the deployment has reached a terminal state. It returns
+// the error (if any) that terminated the deployment.
+func streamDeploymentOperations(ctx context.Context, subscriptionID, resourceGroupName, deploymentName string, clientOptions *arm.ClientOptions, poller *runtime.Poller[armresources.DeploymentsClientCreateOrUpdateResponse]) error {
+	operationsClient, err := armresources.NewDeploymentOperationsClient(subscriptionID, credential, clientOptions)
+	if err != nil {
+		return err
+	}
+
+	printed := make(map[string]bool)
+
+	for !poller.Done() {
+		if err := printNewDeploymentOperations(ctx, operationsClient, resourceGroupName, deploymentName, printed); err != nil {
+			log.Printf("Unable to list deployment operations: %v", err)
+		}
+
+		if _, err := poller.Poll(ctx); err != nil {
+			return fmt.Errorf("polling deployment: %w", err)
+		}
+
+		if !poller.Done() {
+			time.Sleep(deploymentPollInterval)
+		}
+	}
+
+	if _, err := poller.Result(ctx); err != nil {
+		return err
+	}
+
+	// One last pass picks up any operations that only completed between
+	// the final Poll call above and the deployment reaching its terminal
+	// state.
+	if err := printNewDeploymentOperations(ctx, operationsClient, resourceGroupName, deploymentName, printed); err != nil {
+		log.Printf("Unable to list deployment operations: %v", err)
+	}
+
+	return nil
+}
+
+// printNewDeploymentOperations lists deploymentName's operations and
+// prints each (operation, provisioning state) pair not already present in
+// printed, so a caller polling in a loop doesn't reprint operations whose
+// state hasn't changed since the last pass.
+func printNewDeploymentOperations(ctx context.Context, operationsClient *armresources.DeploymentOperationsClient, resourceGroupName, deploymentName string, printed map[string]bool) error {
+	pager := operationsClient.NewListPager(resourceGroupName, deploymentName, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, op := range page.Value {
+			if op.OperationID == nil || op.Properties == nil || op.Properties.TargetResource == nil {
+				continue
+			}
+
+			state := derefString(op.Properties.ProvisioningState)
+			key := *op.OperationID + "|" + state
+			if printed[key] {
+				continue
+			}
+			printed[key] = true
+
+			fmt.Printf("  %s: %s\n", derefString(op.Properties.TargetResource.ResourceName), state)
+		}
+	}
+
+	return nil
+}
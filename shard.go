@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/Microsoft/azure-vhd-utils/vhdcore/common"
+	"github.com/Microsoft/azure-vhd-utils/vhdcore/diskstream"
+)
+
+const shardContainerName = "linuxkitshard"
+const shardBlobName = "shard.vhd"
+const shardSASValidity = time.Hour
+
+// uploadVHDSharded spreads ranges across shardCount storage accounts
+// (named accountNamePrefix0, accountNamePrefix1, ...), each created on
+// demand, so a single account's ingress cap doesn't bound upload
+// throughput for very large images. This mirrors the storageAccountState
+// pool in Kubernetes' BlobDiskController. Once every shard has finished
+// uploading its share, the ranges are copied server-side from the shard
+// blobs into destClient with UploadPagesFromURL, and the now-unneeded
+// shard accounts are deleted.
+func uploadVHDSharded(ctx context.Context, diskStream *diskstream.DiskStream, ranges []*common.IndexRange, parallelism int, destClient *pageblob.Client, resourceGroupName, accountNamePrefix, location, sku string, shardCount int, environment *cloudEnvironment, state *uploadState, statePath, md5 string) error {
+	shardRanges := make([][]*common.IndexRange, shardCount)
+	for i, r := range ranges {
+		shard := i % shardCount
+		shardRanges[shard] = append(shardRanges[shard], r)
+	}
+
+	shardClients := make([]*pageblob.Client, shardCount)
+	shardCredentials := make([]*azblob.SharedKeyCredential, shardCount)
+	for i := 0; i < shardCount; i++ {
+		if len(shardRanges[i]) == 0 {
+			continue
+		}
+
+		shardAccountName := fmt.Sprintf("%s%d", accountNamePrefix, i)
+		fmt.Printf("Ensuring shard storage account %s\n", shardAccountName)
+		if err := ensureInfrastructure(ctx, resourceGroupName, shardAccountName, location, sku); err != nil {
+			return fmt.Errorf("ensuring shard account %s: %w", shardAccountName, err)
+		}
+
+		shardCredential, err := accountSharedKeyCredential(ctx, resourceGroupName, shardAccountName)
+		if err != nil {
+			return fmt.Errorf("authenticating to shard account %s: %w", shardAccountName, err)
+		}
+		shardCredentials[i] = shardCredential
+
+		serviceURL := fmt.Sprintf("https://%s.blob.%s/", shardAccountName, environment.StorageEndpointSuffix)
+		shardServiceClient, err := azblob.NewClientWithSharedKeyCredential(serviceURL, shardCredential, nil)
+		if err != nil {
+			return fmt.Errorf("creating blob service client for shard account %s: %w", shardAccountName, err)
+		}
+
+		shardContainerClient := shardServiceClient.ServiceClient().NewContainerClient(shardContainerName)
+		if _, err := shardContainerClient.Create(ctx, nil); err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+			return fmt.Errorf("creating shard container on %s: %w", shardAccountName, err)
+		}
+
+		shardPageBlobClient := shardContainerClient.NewPageBlobClient(shardBlobName)
+		if _, err := shardPageBlobClient.Create(ctx, diskStream.GetSize(), nil); err != nil {
+			return fmt.Errorf("creating shard blob on %s: %w", shardAccountName, err)
+		}
+
+		shardClients[i] = shardPageBlobClient
+	}
+
+	for i := 0; i < shardCount; i++ {
+		if shardClients[i] == nil {
+			continue
+		}
+
+		fmt.Printf("Uploading %d ranges to shard %d\n", len(shardRanges[i]), i)
+		if err := uploadRangesToPageBlob(ctx, shardClients[i], diskStream, shardRanges[i], parallelism, &uploadState{}, "", ""); err != nil {
+			return fmt.Errorf("uploading to shard %d: %w", i, err)
+		}
+	}
+
+	for i := 0; i < shardCount; i++ {
+		if shardClients[i] == nil {
+			continue
+		}
+
+		fmt.Printf("Stitching shard %d into destination blob\n", i)
+		sourceURL, err := sasURLForBlob(shardClients[i].URL(), shardContainerName, shardBlobName, shardCredentials[i])
+		if err != nil {
+			return fmt.Errorf("signing SAS for shard %d: %w", i, err)
+		}
+
+		for _, r := range shardRanges[i] {
+			length := r.Length()
+			_, err := destClient.UploadPagesFromURL(ctx, sourceURL, r.Start, r.Start, length, nil)
+			if err != nil {
+				return fmt.Errorf("copying range %d-%d from shard %d: %w", r.Start, r.End, i, err)
+			}
+
+			if statePath != "" {
+				if err := state.markUploaded(statePath, md5, r); err != nil {
+					return fmt.Errorf("persisting upload state for range %d-%d: %w", r.Start, r.End, err)
+				}
+			}
+		}
+	}
+
+	if statePath != "" {
+		if err := state.flush(statePath); err != nil {
+			return fmt.Errorf("persisting upload state: %w", err)
+		}
+	}
+
+	for i := 0; i < shardCount; i++ {
+		if shardClients[i] == nil {
+			continue
+		}
+
+		shardAccountName := fmt.Sprintf("%s%d", accountNamePrefix, i)
+		fmt.Printf("Cleaning up shard storage account %s\n", shardAccountName)
+		if _, err := accountsClient.Delete(ctx, resourceGroupName, shardAccountName, nil); err != nil {
+			return fmt.Errorf("deleting shard account %s: %w", shardAccountName, err)
+		}
+	}
+
+	return nil
+}
+
+// sasURLForBlob appends a short-lived, read-only SAS token to blobURL,
+// signed with credential. UploadPagesFromURL needs the source to be
+// readable by the destination account, and the shard containers are
+// private, so the bare blob URL returned by pageblob.Client.URL() is not
+// enough on its own.
+func sasURLForBlob(blobURL, containerName, blobName string, credential *azblob.SharedKeyCredential) (string, error) {
+	now := time.Now().Add(-5 * time.Minute).UTC()
+
+	signatureValues := sas.BlobSignatureValues{
+		Protocol:      sas.ProtocolHTTPS,
+		StartTime:     now,
+		ExpiryTime:    now.Add(shardSASValidity),
+		Permissions:   (&sas.BlobPermissions{Read: true}).String(),
+		ContainerName: containerName,
+		BlobName:      blobName,
+	}
+
+	queryParams, err := signatureValues.SignWithSharedKey(credential)
+	if err != nil {
+		return "", err
+	}
+
+	return blobURL + "?" + queryParams.Encode(), nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Microsoft/azure-vhd-utils/vhdcore/common"
+)
+
+const uploadStateSuffix = ".upload-state.json"
+
+// stateFlushInterval throttles how often markUploaded rewrites the state
+// file: for a multi-GB image split into thousands of ranges, flushing the
+// whole (monotonically growing) UploadedRanges list on every single
+// completed range is O(n²) disk I/O and serializes every worker on the
+// state mutex. A crash between flushes loses at most one interval's worth
+// of completed ranges, which is re-uploaded harmlessly on the next
+// --resume.
+const stateFlushInterval = 2 * time.Second
+
+// uploadState records which page ranges of a VHD have already been written
+// to the destination blob, plus the MD5 of the source file and the full
+// uploadable-range list they belong to, so that a crashed or interrupted
+// push can resume with --resume instead of re-hashing and re-uploading the
+// whole image. SourceSize/SourceModTime let a resumed run trust MD5 and
+// AllRanges without re-reading the source file, as long as neither has
+// changed since the state was written.
+type uploadState struct {
+	mu             sync.Mutex
+	lastFlush      time.Time
+	MD5            string          `json:"md5"`
+	SourceSize     int64           `json:"sourceSize"`
+	SourceModTime  int64           `json:"sourceModTime"`
+	AllRanges      []uploadedRange `json:"allRanges"`
+	UploadedRanges []uploadedRange `json:"uploadedRanges"`
+}
+
+type uploadedRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+func uploadStatePath(imagePath string) string {
+	return imagePath + uploadStateSuffix
+}
+
+// loadUploadState reads the state file next to imagePath. A missing file is
+// not an error: it just means there is nothing to resume from yet.
+func loadUploadState(path string) (*uploadState, error) {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &uploadState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state uploadState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// matchesSource reports whether sourceInfo (the current source file's
+// os.FileInfo) still matches the size and modification time recorded the
+// last time this state was written. A match means the file has not
+// changed since, so a resumed push can trust MD5 and AllRanges instead of
+// re-hashing and re-scanning it.
+func (s *uploadState) matchesSource(sourceInfo os.FileInfo) bool {
+	return s.MD5 != "" && s.SourceSize == sourceInfo.Size() && s.SourceModTime == sourceInfo.ModTime().Unix()
+}
+
+// allIndexRanges converts the cached AllRanges back into the
+// *common.IndexRange slice LocateUploadableRanges/DetectEmptyRanges would
+// have produced, so a resumed push with a matching source can skip calling
+// either of them.
+func (s *uploadState) allIndexRanges() []*common.IndexRange {
+	ranges := make([]*common.IndexRange, len(s.AllRanges))
+	for i, r := range s.AllRanges {
+		ranges[i] = &common.IndexRange{Start: r.Start, End: r.End}
+	}
+	return ranges
+}
+
+// recordSource persists md5 and the freshly computed uploadable-range list
+// for a source file with the given os.FileInfo, so a later --resume can
+// skip LocateUploadableRanges, DetectEmptyRanges and the full-file MD5
+// hash entirely instead of just skipping already-uploaded ranges.
+func (s *uploadState) recordSource(path, md5 string, sourceInfo os.FileInfo, ranges []*common.IndexRange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.MD5 = md5
+	s.SourceSize = sourceInfo.Size()
+	s.SourceModTime = sourceInfo.ModTime().Unix()
+	s.AllRanges = make([]uploadedRange, len(ranges))
+	for i, r := range ranges {
+		s.AllRanges[i] = uploadedRange{Start: r.Start, End: r.End}
+	}
+
+	return s.flushLocked(path)
+}
+
+// pendingRanges drops every range already recorded as uploaded when md5
+// matches the state's MD5 (a mismatch means the source file changed since
+// the state file was written, so nothing can be safely skipped).
+func (s *uploadState) pendingRanges(md5 string, ranges []*common.IndexRange) []*common.IndexRange {
+	if s.MD5 != md5 || len(s.UploadedRanges) == 0 {
+		return ranges
+	}
+
+	done := make(map[uploadedRange]bool, len(s.UploadedRanges))
+	for _, r := range s.UploadedRanges {
+		done[r] = true
+	}
+
+	pending := ranges[:0:0]
+	for _, r := range ranges {
+		if !done[uploadedRange{Start: r.Start, End: r.End}] {
+			pending = append(pending, r)
+		}
+	}
+
+	return pending
+}
+
+// markUploaded records a completed range, flushing the state file to disk
+// at most once per stateFlushInterval. Call flush once all uploads have
+// finished to persist whatever was recorded since the last flush.
+func (s *uploadState) markUploaded(path, md5 string, r *common.IndexRange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.MD5 = md5
+	s.UploadedRanges = append(s.UploadedRanges, uploadedRange{Start: r.Start, End: r.End})
+
+	if time.Since(s.lastFlush) < stateFlushInterval {
+		return nil
+	}
+
+	return s.flushLocked(path)
+}
+
+// flush unconditionally persists the current state to path, bypassing
+// markUploaded's throttle. Callers should call this once after a batch of
+// uploads finishes, so progress recorded since the last throttled flush
+// isn't lost.
+func (s *uploadState) flush(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flushLocked(path)
+}
+
+// flushLocked serializes the state to path via a temp-file-plus-rename, so
+// a crash never leaves a torn state file behind. Callers must hold s.mu.
+func (s *uploadState) flushLocked(path string) error {
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	s.lastFlush = time.Now()
+	return nil
+}